@@ -0,0 +1,46 @@
+package koding
+
+import "time"
+
+// Progress describes the state of a long-running provider operation, such
+// as Resize, at a single point in time, so callers can drive a progress bar
+// or decide whether to cancel.
+type Progress struct {
+	Step     int
+	StepName string
+	Percent  int
+	ETA      time.Duration
+}
+
+const resizeSteps = 14
+
+// newProgress builds the Progress value for step n of Resize's 14 steps,
+// estimating the remaining time from how long the operation has run so far.
+func newProgress(n int, name string, started time.Time) Progress {
+	elapsed := time.Since(started)
+
+	var eta time.Duration
+	if n > 0 {
+		perStep := elapsed / time.Duration(n)
+		eta = perStep * time.Duration(resizeSteps-n)
+	}
+
+	return Progress{
+		Step:     n,
+		StepName: name,
+		Percent:  n * 100 / resizeSteps,
+		ETA:      eta,
+	}
+}
+
+// sendProgress emits p on progress without blocking if nobody is
+// listening; progress may be nil, in which case this is a no-op.
+func sendProgress(progress chan<- Progress, p Progress) {
+	if progress == nil {
+		return
+	}
+	select {
+	case progress <- p:
+	default:
+	}
+}
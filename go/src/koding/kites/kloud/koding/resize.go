@@ -1,18 +1,30 @@
 package koding
 
 import (
+	"context"
 	"fmt"
 	"koding/kites/kloud/klient"
+	"koding/kites/kloud/logging"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/koding/kloud/machinestate"
 	"github.com/koding/kloud/protocol"
-	"github.com/koding/kloud/waitstate"
 	"github.com/mitchellh/goamz/ec2"
 )
 
-func (p *Provider) Resize(opts *protocol.Machine) (resArtifact *protocol.Artifact, resErr error) {
+// Resize runs ResizeContext with a background context and no progress
+// reporting, for callers that don't need cancellation.
+func (p *Provider) Resize(opts *protocol.Machine) (*protocol.Artifact, error) {
+	return p.ResizeContext(context.Background(), opts, nil)
+}
+
+// ResizeContext grows a machine's volume in place. ctx governs cancellation
+// of the long polling waits below (a stuck snapshot or volume can otherwise
+// hang indefinitely); progress, if non-nil, receives a Progress update
+// as each of the steps below begins.
+func (p *Provider) ResizeContext(ctx context.Context, opts *protocol.Machine, progress chan<- Progress) (resArtifact *protocol.Artifact, resErr error) {
 	/*
 		0. Check if size is eglible (not equal or less than the current size)
 		1. Stop the instance
@@ -38,13 +50,33 @@ func (p *Provider) Resize(opts *protocol.Machine) (resArtifact *protocol.Artifac
 		return nil, err
 	}
 
+	backend, err := p.volumeBackend(opts, a.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	username, _ := opts.Builder["username"].(string)
+	log := logging.New(os.Stdout).WithFields(logging.Fields{
+		"machine_id":  opts.MachineId,
+		"username":    username,
+		"instance_id": a.Id(),
+	})
+
+	started := time.Now()
+	step := func(n int, name string) func() {
+		sendProgress(progress, newProgress(n, name, started))
+		return log.Step(n, name)
+	}
+
 	// 0. Check if size is eglible (not equal or less than the current size)
 	// 2. Get VolumeId of current instance
-	a.Log.Info("0. Checking if size is eglible for instance %s", a.Id())
+	done := step(0, "Checking if size is eglible for instance "+a.Id())
 	instance, err := a.Instance(a.Id())
 	if err != nil {
 		return nil, err
 	}
+	log = log.WithFields(logging.Fields{"region": instance.AvailZone})
+	done()
 
 	if len(instance.BlockDevices) == 0 {
 		return nil, fmt.Errorf("fatal error: no block device available")
@@ -69,225 +101,187 @@ func (p *Provider) Resize(opts *protocol.Machine) (resArtifact *protocol.Artifac
 			desiredSize, currentSize)
 	}
 
-	if 100 < desiredSize {
-		return nil, fmt.Errorf("resizing is not allowed. Desired size: %d can't be larger than 100GB",
-			desiredSize)
+	resizePolicy := p.ResizePolicy.forUsername(username)
+
+	if maxSize := resizePolicy.maxSizeGB(); maxSize < desiredSize {
+		return nil, fmt.Errorf("resizing is not allowed. Desired size: %d can't be larger than %dGB",
+			desiredSize, maxSize)
+	}
+
+	volType := a.Builder.VolumeType
+	if volType == "" {
+		volType = "gp2"
+	}
+	if !resizePolicy.allowsVolumeType(volType) {
+		return nil, fmt.Errorf("resizing is not allowed. Volume type %q is not permitted for this account", volType)
+	}
+
+	iops := a.Builder.IOPS
+	if iops == 0 {
+		iops = resizePolicy.DefaultIOPS
+	}
+
+	throughput := a.Builder.Throughput
+	if throughput == 0 {
+		throughput = resizePolicy.DefaultThroughputMBps
 	}
 
 	// 1. Stop the instance
-	a.Log.Info("1. Stopping Machine")
+	done = step(1, "Stopping Machine")
 	if opts.State != machinestate.Stopped {
 		err = a.Stop()
 		if err != nil {
 			return nil, err
 		}
 	}
+	done()
 
 	p.UpdateState(opts.MachineId, machinestate.Pending)
 
 	// 3. Get AvailabilityZone of current instance
-	a.Log.Info("3. Getting Avail Zone")
+	done = step(3, "Getting Avail Zone")
 	availZone := instance.AvailZone
+	done()
 
 	// 4. Create new snapshot from that given VolumeId
-	a.Log.Info("4. Create snapshot from volume %s", oldVolumeId)
+	done = step(4, "Create snapshot from volume "+oldVolumeId)
 	snapshotDesc := fmt.Sprintf("Temporary snapshot for instance %s", instance.InstanceId)
-	resp, err := a.Client.CreateSnapshot(oldVolumeId, snapshotDesc)
+	newSnapshotId, err := backend.CreateSnapshot(oldVolumeId, snapshotDesc)
 	if err != nil {
 		return nil, err
 	}
 
-	newSnapshotId := resp.Id
-
-	checkSnapshot := func(currentPercentage int) (machinestate.State, error) {
-		resp, err := a.Client.Snapshots([]string{newSnapshotId}, ec2.NewFilter())
-		if err != nil {
-			return 0, err
-		}
-
-		if resp.Snapshots[0].Status != "completed" {
-			return machinestate.Pending, nil
+	if err := a.AddTag(newSnapshotId, snapshotMachineTag, opts.MachineId); err != nil {
+		log.Warn("Tagging snapshot %s err: %s", newSnapshotId, err)
+	}
+	for k, v := range p.SnapshotPolicy.Tag {
+		if err := a.AddTag(newSnapshotId, k, v); err != nil {
+			log.Warn("Tagging snapshot %s err: %s", newSnapshotId, err)
 		}
-
-		return machinestate.Stopped, nil
 	}
 
-	ws := waitstate.WaitState{StateFunc: checkSnapshot, DesiredState: machinestate.Stopped}
-	if err := ws.Wait(); err != nil {
+	if err := backend.WaitForSnapshot(ctx, newSnapshotId); err != nil {
 		return nil, err
 	}
+	done()
 
-	// 5. Delete snapshot after we are done with all steps
-	defer a.Client.DeleteSnapshots([]string{newSnapshotId})
+	// 5. Delete snapshot after we are done with all steps, unless the
+	// SnapshotPolicy asks us to keep it as a rollback point.
+	defer func() {
+		if p.SnapshotPolicy.retain(resErr == nil) {
+			log.Info("Retaining snapshot %s per SnapshotPolicy", newSnapshotId)
+			return
+		}
+		a.Client.DeleteSnapshots([]string{newSnapshotId})
+	}()
 
 	// 6. Create new volume with the desired size from the snapshot and same availability zone.
-	a.Log.Info("5. Create new volume from snapshot %s", newSnapshotId)
-	volOptions := &ec2.CreateVolume{
-		AvailZone:  availZone,
-		Size:       int64(desiredSize),
-		SnapshotId: newSnapshotId,
-		VolumeType: "gp2", // SSD
-	}
-
-	volResp, err := a.Client.CreateVolume(volOptions)
+	done = step(6, "Create new volume from snapshot "+newSnapshotId)
+	newVolumeId, err := backend.CreateVolume(VolumeCreateOptions{
+		AvailZone:      availZone,
+		Size:           desiredSize,
+		SnapshotID:     newSnapshotId,
+		VolumeType:     volType,
+		IOPS:           iops,
+		ThroughputMBps: throughput,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	newVolumeId := volResp.VolumeId
-
-	checkVolume := func(currentPercentage int) (machinestate.State, error) {
-		resp, err := a.Client.Volumes([]string{newVolumeId}, ec2.NewFilter())
-		if err != nil {
-			return 0, err
-		}
-
-		if resp.Volumes[0].Status != "available" {
-			return machinestate.Pending, nil
-		}
-
-		return machinestate.Stopped, nil
-	}
-
-	ws = waitstate.WaitState{StateFunc: checkVolume, DesiredState: machinestate.Stopped}
-	if err := ws.Wait(); err != nil {
+	if err := backend.WaitForVolume(ctx, newVolumeId); err != nil {
 		return nil, err
 	}
+	done()
 
 	// 7. Delete volume if something goes wrong in following steps
 	defer func() {
 		if resErr != nil {
-			a.Log.Info("An error occured, deleting new volume %s", newVolumeId)
-			_, err := a.Client.DeleteVolume(newVolumeId)
-			if err != nil {
-				a.Log.Error(err.Error())
+			log.Info("An error occured, deleting new volume %s", newVolumeId)
+			if err := backend.Delete(newVolumeId); err != nil {
+				log.Error(err.Error())
 			}
 		}
 	}()
 
 	// 8. Detach the volume of current stopped instance
-	a.Log.Info("6. Detach old volume %s", oldVolumeId)
-	if _, err := a.Client.DetachVolume(oldVolumeId); err != nil {
-		return nil, err
-	}
-
-	checkDetaching := func(currentPercentage int) (machinestate.State, error) {
-		resp, err := a.Client.Volumes([]string{oldVolumeId}, ec2.NewFilter())
-		if err != nil {
-			return 0, err
-		}
-		vol := resp.Volumes[0]
-
-		// ready!
-		if len(vol.Attachments) == 0 {
-			return machinestate.Stopped, nil
-		}
-
-		// otherwise wait until it's detached
-		if vol.Attachments[0].Status != "detached" {
-			return machinestate.Pending, nil
-		}
-
-		return machinestate.Stopped, nil
-	}
-
-	ws = waitstate.WaitState{StateFunc: checkDetaching, DesiredState: machinestate.Stopped}
-	if err := ws.Wait(); err != nil {
+	done = step(8, "Detach old volume "+oldVolumeId)
+	if err := backend.Detach(ctx, oldVolumeId, a.Id()); err != nil {
 		return nil, err
 	}
+	done()
 
 	// 9. Reattach old volume if something goes wrong, if not delete it
 	defer func() {
 		// if something goes wrong  detach the newly attached volume and attach
 		// back the old volume  so it can be used again
 		if resErr != nil {
-			a.Log.Info("An error occured, re attaching old volume %s", a.Id())
-			_, err := a.Client.DetachVolume(newVolumeId)
-			if err != nil {
-				a.Log.Error(err.Error())
+			log.Info("An error occured, re attaching old volume %s", a.Id())
+			if err := backend.Detach(ctx, newVolumeId, a.Id()); err != nil {
+				log.Error(err.Error())
 			}
 
-			_, err = a.Client.AttachVolume(oldVolumeId, a.Id(), "/dev/sda1")
-			if err != nil {
-				a.Log.Error(err.Error())
+			if err := backend.Attach(ctx, oldVolumeId, a.Id(), ec2Device); err != nil {
+				log.Error(err.Error())
 			}
 		} else {
 			// if not just delete, it's not used anymore
-			a.Log.Info("Deleting old volume %s", a.Id())
-			go a.Client.DeleteVolume(oldVolumeId)
+			log.Info("Deleting old volume %s", a.Id())
+			go backend.Delete(oldVolumeId)
 		}
 	}()
 
 	// 10. Attach new volume to current stopped instance
-	if _, err := a.Client.AttachVolume(newVolumeId, a.Id(), "/dev/sda1"); err != nil {
-		return nil, err
-	}
-
-	checkAttaching := func(currentPercentage int) (machinestate.State, error) {
-		resp, err := a.Client.Volumes([]string{newVolumeId}, ec2.NewFilter())
-		if err != nil {
-			return 0, err
-		}
-
-		vol := resp.Volumes[0]
-
-		if len(vol.Attachments) == 0 {
-			return machinestate.Pending, nil
-		}
-
-		if vol.Attachments[0].Status != "attached" {
-			return machinestate.Pending, nil
-		}
-
-		return machinestate.Stopped, nil
-	}
-
-	ws = waitstate.WaitState{StateFunc: checkAttaching, DesiredState: machinestate.Stopped}
-	if err := ws.Wait(); err != nil {
+	done = step(10, "Attach new volume to current stopped instance")
+	if err := backend.Attach(ctx, newVolumeId, a.Id(), ec2Device); err != nil {
 		return nil, err
 	}
+	done()
 
 	// 11. Start the stopped instance
+	done = step(11, "Start the stopped instance")
 	artifact, err := a.Start()
 	if err != nil {
 		return nil, err
 	}
+	done()
 
 	// 12. Update Domain record with the new IP
+	done = step(12, "Update Domain record with the new IP")
 	machineData, ok := opts.CurrentData.(*Machine)
 	if !ok {
 		return nil, fmt.Errorf("current data is malformed: %v", opts.CurrentData)
 	}
 
-	username := opts.Builder["username"].(string)
-
 	if err := p.UpdateDomain(artifact.IpAddress, machineData.Domain, username); err != nil {
 		return nil, err
 	}
 
-	a.Log.Info("[%s] Updating user domain tag '%s' of instance '%s'",
-		opts.MachineId, machineData.Domain, artifact.InstanceId)
+	log.Info("Updating user domain tag '%s' of instance '%s'", machineData.Domain, artifact.InstanceId)
 	if err := a.AddTag(artifact.InstanceId, "koding-domain", machineData.Domain); err != nil {
 		return nil, err
 	}
+	done()
 
 	artifact.DomainName = machineData.Domain
 
-	fmt.Printf("artifact %+v\n", artifact)
+	log.Debug("artifact %+v", artifact)
 
 	// 13. Check if Klient is running
+	done = step(13, "Check if Klient is running")
 	a.Push("Checking remote machine", 90, machinestate.Starting)
-	p.Log.Info("[%s] Connecting to remote Klient instance", opts.MachineId)
+	log.Info("Connecting to remote Klient instance")
 	klientRef, err := klient.NewWithTimeout(p.Kite, machineData.QueryString, time.Minute*1)
 	if err != nil {
-		p.Log.Warning("Connecting to remote Klient instance err: %s", err)
+		log.Warn("Connecting to remote Klient instance err: %s", err)
 	} else {
 		defer klientRef.Close()
-		p.Log.Info("[%s] Sending a ping message", opts.MachineId)
+		log.Info("Sending a ping message")
 		if err := klientRef.Ping(); err != nil {
-			p.Log.Warning("Sending a ping message err:", err)
+			log.Warn("Sending a ping message err: %s", err)
 		}
 	}
+	done()
 
 	return artifact, nil
 }
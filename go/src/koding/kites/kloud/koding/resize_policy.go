@@ -0,0 +1,64 @@
+package koding
+
+// ResizePolicy controls which volume types, sizes and IOPS/throughput
+// Resize allows a user to request. The zero value reproduces the historic
+// behavior: gp2 only, capped at defaultMaxSizeGB, no provisioned IOPS or
+// throughput.
+type ResizePolicy struct {
+	// AllowedVolumeTypes lists the EC2 volume types Resize may create
+	// (gp2, gp3, io1, io2, st1, ...). Empty means gp2 only.
+	AllowedVolumeTypes []string
+
+	// MaxSizeGB caps the size Resize will grow a volume to. Zero means
+	// defaultMaxSizeGB.
+	MaxSizeGB int
+
+	// DefaultIOPS is used for io1/io2/gp3 volumes when the Builder doesn't
+	// specify its own.
+	DefaultIOPS int64
+
+	// DefaultThroughputMBps is handed to the volume backend when the
+	// Builder doesn't specify its own. The EC2 backend does not pass it on,
+	// so EC2 volumes are created with the volume type's default throughput.
+	DefaultThroughputMBps int64
+
+	// PerUsernameOverrides replaces the whole policy for the given
+	// username, e.g. to give paying users on higher tiers more headroom.
+	PerUsernameOverrides map[string]ResizePolicy
+}
+
+const defaultMaxSizeGB = 100
+
+var defaultAllowedVolumeTypes = []string{"gp2"}
+
+// forUsername returns the ResizePolicy that applies to username: its own
+// override if one exists in PerUsernameOverrides, otherwise r itself.
+func (r ResizePolicy) forUsername(username string) ResizePolicy {
+	if override, ok := r.PerUsernameOverrides[username]; ok {
+		return override
+	}
+	return r
+}
+
+func (r ResizePolicy) maxSizeGB() int {
+	if r.MaxSizeGB > 0 {
+		return r.MaxSizeGB
+	}
+	return defaultMaxSizeGB
+}
+
+func (r ResizePolicy) allowedVolumeTypes() []string {
+	if len(r.AllowedVolumeTypes) > 0 {
+		return r.AllowedVolumeTypes
+	}
+	return defaultAllowedVolumeTypes
+}
+
+func (r ResizePolicy) allowsVolumeType(volType string) bool {
+	for _, t := range r.allowedVolumeTypes() {
+		if t == volType {
+			return true
+		}
+	}
+	return false
+}
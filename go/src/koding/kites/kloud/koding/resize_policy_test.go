@@ -0,0 +1,54 @@
+package koding
+
+import "testing"
+
+func TestResizePolicyMaxSizeGBDefaultsWhenUnset(t *testing.T) {
+	var r ResizePolicy
+	if got := r.maxSizeGB(); got != defaultMaxSizeGB {
+		t.Errorf("maxSizeGB() = %d, want %d", got, defaultMaxSizeGB)
+	}
+
+	r = ResizePolicy{MaxSizeGB: 500}
+	if got := r.maxSizeGB(); got != 500 {
+		t.Errorf("maxSizeGB() = %d, want 500", got)
+	}
+}
+
+func TestResizePolicyAllowsVolumeType(t *testing.T) {
+	var r ResizePolicy
+	if !r.allowsVolumeType("gp2") {
+		t.Error("zero-value ResizePolicy should allow gp2")
+	}
+	if r.allowsVolumeType("io1") {
+		t.Error("zero-value ResizePolicy should not allow io1")
+	}
+
+	r = ResizePolicy{AllowedVolumeTypes: []string{"gp3", "io1"}}
+	if !r.allowsVolumeType("gp3") || !r.allowsVolumeType("io1") {
+		t.Error("explicit AllowedVolumeTypes should allow gp3 and io1")
+	}
+	if r.allowsVolumeType("gp2") {
+		t.Error("explicit AllowedVolumeTypes should not fall back to gp2")
+	}
+}
+
+func TestResizePolicyForUsernameFallsBackToDefault(t *testing.T) {
+	r := ResizePolicy{
+		MaxSizeGB: 100,
+		PerUsernameOverrides: map[string]ResizePolicy{
+			"paying-user": {MaxSizeGB: 1000, AllowedVolumeTypes: []string{"gp3", "io2"}},
+		},
+	}
+
+	if got := r.forUsername("regular-user"); got.maxSizeGB() != 100 {
+		t.Errorf("forUsername(regular-user).maxSizeGB() = %d, want 100", got.maxSizeGB())
+	}
+
+	override := r.forUsername("paying-user")
+	if override.maxSizeGB() != 1000 {
+		t.Errorf("forUsername(paying-user).maxSizeGB() = %d, want 1000", override.maxSizeGB())
+	}
+	if !override.allowsVolumeType("io2") {
+		t.Error("paying-user override should allow io2")
+	}
+}
@@ -0,0 +1,238 @@
+package koding
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/koding/kloud/machinestate"
+	"github.com/koding/kloud/protocol"
+	"github.com/koding/kloud/waitstate"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// SnapshotPolicy controls how the snapshots Resize creates are retained and
+// later pruned. The zero value reproduces the old behavior of deleting the
+// snapshot as soon as the resize finishes, which leaves no rollback point if
+// something goes wrong after the fact.
+type SnapshotPolicy struct {
+	// RetainOnSuccess keeps the resize snapshot instead of deleting it once
+	// the resize completes successfully.
+	RetainOnSuccess bool
+
+	// RetainOnFailure keeps the resize snapshot when the resize fails, so it
+	// can be inspected or rolled back to instead of being lost with the
+	// volume it was taken from.
+	RetainOnFailure bool
+
+	// MaxAge is the maximum age a retained snapshot may reach before
+	// PruneSnapshots deletes it. Zero disables age-based pruning.
+	MaxAge time.Duration
+
+	// MaxPerMachine caps the number of retained snapshots kept per machine.
+	// PruneSnapshots deletes the oldest ones past the cap. Zero disables
+	// count-based pruning.
+	MaxPerMachine int
+
+	// Tag is attached to every snapshot Resize creates, in addition to the
+	// "koding-machine-id" tag PruneSnapshots relies on to find them again.
+	Tag map[string]string
+}
+
+const snapshotMachineTag = "koding-machine-id"
+
+// prunableSnapshot pairs a snapshot id with its parsed creation time, so
+// PruneSnapshots can sort and age-compare snapshots without re-parsing
+// StartTime on every comparison.
+type prunableSnapshot struct {
+	id        string
+	startTime time.Time
+}
+
+// retain reports whether a resize snapshot should survive past the resize
+// that created it, given whether that resize succeeded.
+func (s SnapshotPolicy) retain(success bool) bool {
+	if success {
+		return s.RetainOnSuccess
+	}
+	return s.RetainOnFailure
+}
+
+// snapshotsToPrune sorts snaps newest-first and returns the ids of those
+// exceeding policy's MaxPerMachine count or MaxAge, measured against now.
+// Split out of PruneSnapshots so the pruning rules can be tested without a
+// live EC2 client.
+func snapshotsToPrune(snaps []prunableSnapshot, policy SnapshotPolicy, now time.Time) []string {
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].startTime.After(snaps[j].startTime)
+	})
+
+	var toDelete []string
+	for i, snap := range snaps {
+		if policy.MaxPerMachine > 0 && i >= policy.MaxPerMachine {
+			toDelete = append(toDelete, snap.id)
+			continue
+		}
+
+		if policy.MaxAge > 0 && now.Sub(snap.startTime) > policy.MaxAge {
+			toDelete = append(toDelete, snap.id)
+		}
+	}
+	return toDelete
+}
+
+// PruneSnapshots deletes snapshots retained by past Resize calls for the
+// given machine that have exceeded the Provider's SnapshotPolicy age or
+// count limits.
+func (p *Provider) PruneSnapshots(machineID string) error {
+	a, err := p.NewClient(&protocol.Machine{MachineId: machineID})
+	if err != nil {
+		return err
+	}
+
+	filter := ec2.NewFilter()
+	filter.Add("tag:"+snapshotMachineTag, machineID)
+
+	resp, err := a.Client.Snapshots(nil, filter)
+	if err != nil {
+		return err
+	}
+
+	// Like ec2.Volume.Size, the vendored goamz client hands back
+	// Snapshot.StartTime as the raw XML string rather than a parsed
+	// time.Time, so it has to be parsed here before it can be compared.
+	snaps := make([]prunableSnapshot, 0, len(resp.Snapshots))
+	for _, snap := range resp.Snapshots {
+		startTime, err := time.Parse(time.RFC3339Nano, snap.StartTime)
+		if err != nil {
+			return fmt.Errorf("parsing start time of snapshot %s: %s", snap.Id, err)
+		}
+		snaps = append(snaps, prunableSnapshot{id: snap.Id, startTime: startTime})
+	}
+
+	toDelete := snapshotsToPrune(snaps, p.SnapshotPolicy, time.Now())
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	a.Log.Info("Pruning %d snapshot(s) for machine %s", len(toDelete), machineID)
+	_, err = a.Client.DeleteSnapshots(toDelete)
+	return err
+}
+
+// Rollback restores a machine to a snapshot retained by a previous Resize
+// call: it creates a fresh volume from the snapshot, detaches whatever
+// volume is currently attached and attaches the new one in its place,
+// reusing the same wait/defer machinery Resize uses.
+func (p *Provider) Rollback(opts *protocol.Machine, snapshotID string) (resArtifact *protocol.Artifact, resErr error) {
+	defer p.Unlock(opts.MachineId)
+
+	a, err := p.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := a.Instance(a.Id())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instance.BlockDevices) == 0 {
+		return nil, fmt.Errorf("fatal error: no block device available")
+	}
+
+	currentVolumeId := instance.BlockDevices[0].VolumeId
+
+	if opts.State != machinestate.Stopped {
+		a.Log.Info("Rollback: stopping instance %s", a.Id())
+		if err := a.Stop(); err != nil {
+			return nil, err
+		}
+	}
+
+	snapResp, err := a.Client.Snapshots([]string{snapshotID}, ec2.NewFilter())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapResp.Snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+
+	a.Log.Info("Rollback: creating volume from snapshot %s", snapshotID)
+	volResp, err := a.Client.CreateVolume(&ec2.CreateVolume{
+		AvailZone:  instance.AvailZone,
+		SnapshotId: snapshotID,
+		VolumeType: "gp2",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	newVolumeId := volResp.VolumeId
+
+	checkVolume := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := a.Client.Volumes([]string{newVolumeId}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.Volumes[0].Status != "available" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws := waitstate.WaitState{StateFunc: checkVolume, DesiredState: machinestate.Stopped}
+	if err := ws.Wait(); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if resErr != nil {
+			a.Log.Info("Rollback failed, deleting new volume %s", newVolumeId)
+			if _, err := a.Client.DeleteVolume(newVolumeId); err != nil {
+				a.Log.Error(err.Error())
+			}
+		}
+	}()
+
+	a.Log.Info("Rollback: detaching current volume %s", currentVolumeId)
+	if _, err := a.Client.DetachVolume(currentVolumeId); err != nil {
+		return nil, err
+	}
+
+	checkDetaching := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := a.Client.Volumes([]string{currentVolumeId}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+		vol := resp.Volumes[0]
+
+		if len(vol.Attachments) == 0 {
+			return machinestate.Stopped, nil
+		}
+
+		if vol.Attachments[0].Status != "detached" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws = waitstate.WaitState{StateFunc: checkDetaching, DesiredState: machinestate.Stopped}
+	if err := ws.Wait(); err != nil {
+		return nil, err
+	}
+
+	a.Log.Info("Rollback: attaching rollback volume %s", newVolumeId)
+	if _, err := a.Client.AttachVolume(newVolumeId, a.Id(), "/dev/sda1"); err != nil {
+		return nil, err
+	}
+
+	go a.Client.DeleteVolume(currentVolumeId)
+
+	return a.Start()
+}
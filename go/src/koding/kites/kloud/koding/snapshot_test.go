@@ -0,0 +1,69 @@
+package koding
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotPolicyRetain(t *testing.T) {
+	cases := []struct {
+		policy  SnapshotPolicy
+		success bool
+		want    bool
+	}{
+		{SnapshotPolicy{RetainOnSuccess: true, RetainOnFailure: false}, true, true},
+		{SnapshotPolicy{RetainOnSuccess: true, RetainOnFailure: false}, false, false},
+		{SnapshotPolicy{RetainOnSuccess: false, RetainOnFailure: true}, true, false},
+		{SnapshotPolicy{RetainOnSuccess: false, RetainOnFailure: true}, false, true},
+		{SnapshotPolicy{}, true, false},
+		{SnapshotPolicy{}, false, false},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.retain(c.success); got != c.want {
+			t.Errorf("retain(%v) with policy %+v = %v, want %v", c.success, c.policy, got, c.want)
+		}
+	}
+}
+
+func TestSnapshotsToPruneByMaxPerMachine(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	snaps := []prunableSnapshot{
+		{id: "snap-oldest", startTime: now.Add(-3 * time.Hour)},
+		{id: "snap-middle", startTime: now.Add(-2 * time.Hour)},
+		{id: "snap-newest", startTime: now.Add(-1 * time.Hour)},
+	}
+
+	toDelete := snapshotsToPrune(snaps, SnapshotPolicy{MaxPerMachine: 2}, now)
+
+	if len(toDelete) != 1 || toDelete[0] != "snap-oldest" {
+		t.Fatalf("snapshotsToPrune = %v, want [snap-oldest]", toDelete)
+	}
+}
+
+func TestSnapshotsToPruneByMaxAge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	snaps := []prunableSnapshot{
+		{id: "snap-old", startTime: now.Add(-48 * time.Hour)},
+		{id: "snap-recent", startTime: now.Add(-1 * time.Hour)},
+	}
+
+	toDelete := snapshotsToPrune(snaps, SnapshotPolicy{MaxAge: 24 * time.Hour}, now)
+
+	if len(toDelete) != 1 || toDelete[0] != "snap-old" {
+		t.Fatalf("snapshotsToPrune = %v, want [snap-old]", toDelete)
+	}
+}
+
+func TestSnapshotsToPruneDisabledByZeroPolicy(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	snaps := []prunableSnapshot{
+		{id: "snap-ancient", startTime: now.Add(-24 * 365 * time.Hour)},
+	}
+
+	toDelete := snapshotsToPrune(snaps, SnapshotPolicy{}, now)
+
+	if len(toDelete) != 0 {
+		t.Fatalf("snapshotsToPrune = %v, want none pruned with zero-value policy", toDelete)
+	}
+}
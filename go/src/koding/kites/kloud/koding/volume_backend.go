@@ -0,0 +1,273 @@
+package koding
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/koding/kloud/machinestate"
+	"github.com/koding/kloud/protocol"
+	"github.com/koding/kloud/waitstate"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// VolumeCreateOptions describes the volume Resize wants a VolumeBackend to
+// create. Not every backend honors every field: IOPS only applies to EC2's
+// io1/io2/gp3 volume types, for instance.
+type VolumeCreateOptions struct {
+	AvailZone  string
+	Size       int
+	SnapshotID string
+	VolumeType string
+
+	// IOPS applies to io1/io2/gp3 volumes. Backends that can't provision
+	// IOPS (or whose vendored client predates the parameter) ignore it.
+	IOPS int64
+
+	// ThroughputMBps applies to gp3 volumes. Backends that can't configure
+	// throughput ignore it.
+	ThroughputMBps int64
+}
+
+// VolumeBackend is the volume lifecycle Resize drives: stop the instance,
+// snapshot its volume, grow it, reattach, start. Extracting it out of
+// Resize lets kloud host machines outside EC2 with the identical workflow.
+// ResizeContext picks its backend itself from opts.Provider and still reads
+// the instance and its current volume through the EC2 client, so a fake
+// backend cannot be substituted into it. Provider-specific status strings ("completed",
+// "available", "attached", ...) stay inside the backend instead of leaking
+// into the orchestration code in resize.go.
+type VolumeBackend interface {
+	// CreateSnapshot snapshots volumeID and returns the new snapshot's id.
+	CreateSnapshot(volumeID, description string) (snapshotID string, err error)
+
+	// WaitForSnapshot blocks until snapshotID is ready to create a volume
+	// from, or ctx is done.
+	WaitForSnapshot(ctx context.Context, snapshotID string) error
+
+	// CreateVolume creates a volume per opts and returns its id.
+	CreateVolume(opts VolumeCreateOptions) (volumeID string, err error)
+
+	// WaitForVolume blocks until volumeID is ready to attach, or ctx is
+	// done.
+	WaitForVolume(ctx context.Context, volumeID string) error
+
+	// Detach detaches volumeID from instanceID and blocks until it's
+	// detached, or ctx is done.
+	Detach(ctx context.Context, volumeID, instanceID string) error
+
+	// Attach attaches volumeID to instanceID at device and blocks until
+	// it's attached, or ctx is done.
+	Attach(ctx context.Context, volumeID, instanceID, device string) error
+
+	// Delete deletes volumeID.
+	Delete(volumeID string) error
+}
+
+// volumeBackend picks the VolumeBackend for opts.Provider. EC2 is the
+// default so existing callers that don't set Provider keep working
+// unchanged.
+func (p *Provider) volumeBackend(opts *protocol.Machine, client *ec2.EC2) (VolumeBackend, error) {
+	switch opts.Provider {
+	case "", "aws", "ec2":
+		return &ec2Backend{client: client}, nil
+	case "digitalocean":
+		return &doBackend{}, nil
+	default:
+		return nil, fmt.Errorf("resize: unsupported provider %q", opts.Provider)
+	}
+}
+
+const ec2Device = "/dev/sda1"
+
+// waitContext runs ws to completion in a goroutine and returns as soon as it
+// finishes or ctx is done, whichever comes first. waitstate.WaitState itself
+// has no notion of a context, so this is how the backend's Wait* methods
+// honor ctx cancellation without blocking past it.
+func waitContext(ctx context.Context, ws waitstate.WaitState) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ws.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ec2Backend is the VolumeBackend backing EC2 gp2/gp3/io1/io2/st1 volumes,
+// the only backend kloud has historically supported.
+type ec2Backend struct {
+	client *ec2.EC2
+}
+
+func (b *ec2Backend) CreateSnapshot(volumeID, description string) (string, error) {
+	resp, err := b.client.CreateSnapshot(volumeID, description)
+	if err != nil {
+		return "", err
+	}
+	return resp.Id, nil
+}
+
+func (b *ec2Backend) WaitForSnapshot(ctx context.Context, snapshotID string) error {
+	check := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := b.client.Snapshots([]string{snapshotID}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.Snapshots[0].Status != "completed" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws := waitstate.WaitState{StateFunc: check, DesiredState: machinestate.Stopped}
+	return waitContext(ctx, ws)
+}
+
+// iopsVolumeTypes are the EC2 volume types that accept a provisioned IOPS
+// parameter. Passing IOPS for any other type (gp2, st1, sc1, ...) is
+// rejected by the EC2 API.
+var iopsVolumeTypes = map[string]bool{"io1": true, "io2": true, "gp3": true}
+
+func (b *ec2Backend) CreateVolume(opts VolumeCreateOptions) (string, error) {
+	volType := opts.VolumeType
+	if volType == "" {
+		volType = "gp2"
+	}
+
+	req := &ec2.CreateVolume{
+		AvailZone:  opts.AvailZone,
+		Size:       int64(opts.Size),
+		SnapshotId: opts.SnapshotID,
+		VolumeType: volType,
+	}
+	if iopsVolumeTypes[volType] {
+		req.IOPS = opts.IOPS
+		// ThroughputMBps (gp3) isn't exposed by the vendored goamz/ec2
+		// client yet, so it's not passed through here.
+	}
+
+	resp, err := b.client.CreateVolume(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.VolumeId, nil
+}
+
+func (b *ec2Backend) WaitForVolume(ctx context.Context, volumeID string) error {
+	check := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := b.client.Volumes([]string{volumeID}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.Volumes[0].Status != "available" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws := waitstate.WaitState{StateFunc: check, DesiredState: machinestate.Stopped}
+	return waitContext(ctx, ws)
+}
+
+func (b *ec2Backend) Detach(ctx context.Context, volumeID, instanceID string) error {
+	if _, err := b.client.DetachVolume(volumeID); err != nil {
+		return err
+	}
+
+	check := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := b.client.Volumes([]string{volumeID}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+		vol := resp.Volumes[0]
+
+		// ready!
+		if len(vol.Attachments) == 0 {
+			return machinestate.Stopped, nil
+		}
+
+		// otherwise wait until it's detached
+		if vol.Attachments[0].Status != "detached" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws := waitstate.WaitState{StateFunc: check, DesiredState: machinestate.Stopped}
+	return waitContext(ctx, ws)
+}
+
+func (b *ec2Backend) Attach(ctx context.Context, volumeID, instanceID, device string) error {
+	if _, err := b.client.AttachVolume(volumeID, instanceID, device); err != nil {
+		return err
+	}
+
+	check := func(currentPercentage int) (machinestate.State, error) {
+		resp, err := b.client.Volumes([]string{volumeID}, ec2.NewFilter())
+		if err != nil {
+			return 0, err
+		}
+
+		vol := resp.Volumes[0]
+
+		if len(vol.Attachments) == 0 {
+			return machinestate.Pending, nil
+		}
+
+		if vol.Attachments[0].Status != "attached" {
+			return machinestate.Pending, nil
+		}
+
+		return machinestate.Stopped, nil
+	}
+
+	ws := waitstate.WaitState{StateFunc: check, DesiredState: machinestate.Stopped}
+	return waitContext(ctx, ws)
+}
+
+func (b *ec2Backend) Delete(volumeID string) error {
+	_, err := b.client.DeleteVolume(volumeID)
+	return err
+}
+
+// doBackend is a stub VolumeBackend for DigitalOcean block storage. kloud
+// doesn't vendor a DigitalOcean client yet, so it reports an honest error
+// instead of pretending to resize a volume it can't reach.
+type doBackend struct{}
+
+func (b *doBackend) CreateSnapshot(volumeID, description string) (string, error) {
+	return "", fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) WaitForSnapshot(ctx context.Context, snapshotID string) error {
+	return fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) CreateVolume(opts VolumeCreateOptions) (string, error) {
+	return "", fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) WaitForVolume(ctx context.Context, volumeID string) error {
+	return fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) Detach(ctx context.Context, volumeID, instanceID string) error {
+	return fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) Attach(ctx context.Context, volumeID, instanceID, device string) error {
+	return fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
+
+func (b *doBackend) Delete(volumeID string) error {
+	return fmt.Errorf("resize: digitalocean backend is not implemented yet")
+}
@@ -0,0 +1,104 @@
+package koding
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/koding/kloud/machinestate"
+	"github.com/koding/kloud/waitstate"
+)
+
+// fakeBackend is a VolumeBackend that records the options it was called
+// with instead of talking to EC2.
+type fakeBackend struct {
+	createVolumeOpts VolumeCreateOptions
+}
+
+func (b *fakeBackend) CreateSnapshot(volumeID, description string) (string, error) {
+	return "snap-fake", nil
+}
+
+func (b *fakeBackend) WaitForSnapshot(ctx context.Context, snapshotID string) error {
+	return nil
+}
+
+func (b *fakeBackend) CreateVolume(opts VolumeCreateOptions) (string, error) {
+	b.createVolumeOpts = opts
+	return "vol-fake", nil
+}
+
+func (b *fakeBackend) WaitForVolume(ctx context.Context, volumeID string) error {
+	return nil
+}
+
+func (b *fakeBackend) Detach(ctx context.Context, volumeID, instanceID string) error {
+	return nil
+}
+
+func (b *fakeBackend) Attach(ctx context.Context, volumeID, instanceID, device string) error {
+	return nil
+}
+
+func (b *fakeBackend) Delete(volumeID string) error {
+	return nil
+}
+
+var _ VolumeBackend = (*fakeBackend)(nil)
+
+func TestFakeBackendRecordsCreateVolumeOptions(t *testing.T) {
+	b := &fakeBackend{}
+
+	volumeID, err := b.CreateVolume(VolumeCreateOptions{
+		AvailZone:  "us-east-1a",
+		Size:       50,
+		SnapshotID: "snap-fake",
+		VolumeType: "io1",
+		IOPS:       1000,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	if volumeID != "vol-fake" {
+		t.Fatalf("CreateVolume returned id %q, want vol-fake", volumeID)
+	}
+	if b.createVolumeOpts.VolumeType != "io1" || b.createVolumeOpts.IOPS != 1000 {
+		t.Fatalf("CreateVolume didn't see the options it was called with: %+v", b.createVolumeOpts)
+	}
+}
+
+func TestWaitContextReturnsWaitStateResult(t *testing.T) {
+	calls := 0
+	ws := waitstate.WaitState{
+		StateFunc: func(currentPercentage int) (machinestate.State, error) {
+			calls++
+			if calls < 2 {
+				return machinestate.Pending, nil
+			}
+			return machinestate.Stopped, nil
+		},
+		DesiredState: machinestate.Stopped,
+	}
+
+	if err := waitContext(context.Background(), ws); err != nil {
+		t.Fatalf("waitContext: %v", err)
+	}
+}
+
+func TestWaitContextReturnsCtxErrOnCancel(t *testing.T) {
+	ws := waitstate.WaitState{
+		StateFunc: func(currentPercentage int) (machinestate.State, error) {
+			time.Sleep(50 * time.Millisecond)
+			return machinestate.Pending, nil
+		},
+		DesiredState: machinestate.Stopped,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := waitContext(ctx, ws); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waitContext = %v, want context.Canceled", err)
+	}
+}
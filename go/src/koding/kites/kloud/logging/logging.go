@@ -0,0 +1,127 @@
+// Package logging provides a structured, leveled logger for kloud's
+// provider actions. Unlike the ad-hoc fmt-style logging scattered across
+// provider methods, every entry carries the correlation fields it was
+// created with (machine id, username, instance id, region, step...), which
+// makes the output scrapable by log aggregators.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Fields is a set of correlation fields bound to a Logger with WithFields.
+type Fields map[string]interface{}
+
+// Logger is a leveled logger that carries a set of fields on every entry it
+// emits.
+type Logger interface {
+	// WithFields returns a new Logger with fields merged into the receiver's
+	// existing fields. Keys in fields override the receiver's.
+	WithFields(fields Fields) Logger
+
+	Debug(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+
+	// Step marks the start of numbered step name and returns a func that
+	// must be called when the step finishes; it emits the matching "done"
+	// entry together with the step's duration.
+	Step(n int, name string) func()
+}
+
+// sink writes one JSON entry per line so kloud logs can be scraped by log
+// aggregators (e.g. an ELK/Loki pipeline).
+type sink struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+// New returns a Logger that writes JSON-encoded entries to out.
+func New(out io.Writer) Logger {
+	return &logger{sink: &sink{out: out}}
+}
+
+type logger struct {
+	fields Fields
+	sink   *sink
+}
+
+func (l *logger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{fields: merged, sink: l.sink}
+}
+
+type entry struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Msg    string    `json:"msg"`
+	Fields Fields    `json:"fields,omitempty"`
+}
+
+func (l *logger) log(level Level, format string, args ...interface{}) {
+	e := entry{
+		Time:   time.Now(),
+		Level:  level.String(),
+		Msg:    fmt.Sprintf(format, args...),
+		Fields: l.fields,
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	if b, err := json.Marshal(e); err == nil {
+		fmt.Fprintln(l.sink.out, string(b))
+	} else {
+		fmt.Fprintln(l.sink.out, e.Msg)
+	}
+}
+
+func (l *logger) Debug(format string, args ...interface{}) { l.log(DebugLevel, format, args...) }
+func (l *logger) Info(format string, args ...interface{})  { l.log(InfoLevel, format, args...) }
+func (l *logger) Warn(format string, args ...interface{})  { l.log(WarnLevel, format, args...) }
+func (l *logger) Error(format string, args ...interface{}) { l.log(ErrorLevel, format, args...) }
+
+func (l *logger) Step(n int, name string) func() {
+	step := l.WithFields(Fields{"step": n})
+	start := time.Now()
+	step.Info("%d. %s", n, name)
+	return func() {
+		step.Info("%d. %s done (%s)", n, name, time.Since(start))
+	}
+}
@@ -0,0 +1,357 @@
+package moh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"koding/kites/kloud/logging"
+)
+
+// SubscribeTransport is the common surface moh's websocket and SSE
+// subscribers provide, so callers can pick one per deployment without
+// depending on a concrete type. SSE traverses corporate proxies and load
+// balancers that mangle websockets far more reliably. Subscriber and
+// SSESubscriber both implement this.
+type SubscribeTransport interface {
+	Subscribe(key string) error
+	Connected() bool
+}
+
+// PublishTransport is the publishing side of the same choice; SSEPublisher
+// implements this.
+type PublishTransport interface {
+	Publish(key string, message []byte) error
+	Connected() bool
+}
+
+// SSESubscriber is a Subscriber alternative that consumes a Publisher over a
+// long-lived text/event-stream HTTP response instead of a websocket.
+type SSESubscriber struct {
+	url     *url.URL
+	handler MessageHandler
+	client  *http.Client
+	log     logging.Logger
+
+	mu          sync.Mutex
+	clientID    string
+	lastEventID string
+	connected   bool
+}
+
+// NewSSESubscriber returns a pointer to a newly created SSESubscriber that
+// opens urlStr's SSE event stream in the background; it returns before the
+// stream is connected, and only a malformed urlStr makes it fail. After creating one you should
+// subscribe to messages with Subscribe, same as with Subscriber.
+func NewSSESubscriber(urlStr string, handler MessageHandler) (*SSESubscriber, error) {
+	parsed, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	s := &SSESubscriber{
+		url:      parsed,
+		handler:  handler,
+		client:   &http.Client{},
+		clientID: clientID,
+		log:      logging.New(os.Stdout).WithFields(logging.Fields{"url": urlStr, "client": clientID}),
+	}
+
+	go s.connector()
+	return s, nil
+}
+
+// Subscribe registers the SSESubscriber to receive messages matching key.
+// An SSE stream only carries data from server to client, so the
+// subscription itself is a normal POST request against the stream URL.
+func (s *SSESubscriber) Subscribe(key string) error {
+	resp, err := s.client.PostForm(s.url.String(), url.Values{
+		"client": {s.clientID},
+		"key":    {key},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("moh: subscribe failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Connected reports whether the event stream is currently open.
+func (s *SSESubscriber) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// connector keeps the event stream open, reconnecting with the last seen
+// event id whenever it drops.
+func (s *SSESubscriber) connector() {
+	for {
+		if err := s.stream(); err != nil {
+			s.log.Warn("sse stream error: %s", err)
+		}
+
+		s.mu.Lock()
+		s.connected = false
+		s.mu.Unlock()
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *SSESubscriber) stream() error {
+	streamURL := *s.url
+	q := streamURL.Query()
+	q.Set("client", s.clientID)
+	streamURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", streamURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	s.mu.Lock()
+	lastEventID := s.lastEventID
+	s.mu.Unlock()
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	s.mu.Lock()
+	s.connected = true
+	s.mu.Unlock()
+
+	return s.readEvents(resp.Body)
+}
+
+func (s *SSESubscriber) readEvents(body io.Reader) error {
+	reader := bufio.NewReader(body)
+	var id string
+	var data []string
+
+	flush := func() {
+		if len(data) == 0 {
+			return
+		}
+		if id != "" {
+			s.mu.Lock()
+			s.lastEventID = id
+			s.mu.Unlock()
+		}
+		s.handler([]byte(strings.Join(data, "\n")))
+		id, data = "", nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+
+		if err != nil {
+			flush()
+			return err
+		}
+	}
+}
+
+type sseEvent struct {
+	id   int64
+	key  string
+	data []byte
+}
+
+// sseClient is a single subscriber's state on the SSEPublisher side: the
+// keys it's interested in and the channel its stream handler drains.
+type sseClient struct {
+	mu   sync.Mutex
+	keys map[string]bool
+	ch   chan sseEvent
+}
+
+const defaultSSERingSize = 256
+
+// SSEPublisher fans out published messages to registered SSE clients, and
+// replays events a reconnecting client missed since its Last-Event-ID from
+// an in-memory ring buffer.
+type SSEPublisher struct {
+	mu      sync.Mutex
+	nextID  int64
+	ring    []sseEvent
+	ringCap int
+	clients map[string]*sseClient
+	log     logging.Logger
+}
+
+// NewSSEPublisher returns an SSEPublisher ready to serve subscribers; wire
+// it into an HTTP server with its ServeHTTP method.
+func NewSSEPublisher() *SSEPublisher {
+	return &SSEPublisher{
+		ringCap: defaultSSERingSize,
+		clients: make(map[string]*sseClient),
+		log:     logging.New(os.Stdout),
+	}
+}
+
+func (p *SSEPublisher) client(id string) *sseClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.clients[id]
+	if !ok {
+		c = &sseClient{keys: make(map[string]bool), ch: make(chan sseEvent, 32)}
+		p.clients[id] = c
+	}
+	return c
+}
+
+// Publish fans out message to every SSE client subscribed to key.
+func (p *SSEPublisher) Publish(key string, message []byte) error {
+	p.mu.Lock()
+	p.nextID++
+	ev := sseEvent{id: p.nextID, key: key, data: message}
+	p.ring = append(p.ring, ev)
+	if len(p.ring) > p.ringCap {
+		p.ring = p.ring[len(p.ring)-p.ringCap:]
+	}
+	clients := make([]*sseClient, 0, len(p.clients))
+	for _, c := range p.clients {
+		clients = append(clients, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		subscribed := c.keys[key]
+		c.mu.Unlock()
+		if !subscribed {
+			continue
+		}
+
+		select {
+		case c.ch <- ev:
+		default:
+			p.log.Warn("sse client is too slow, dropping event for key %s", key)
+		}
+	}
+	return nil
+}
+
+// Connected always reports true: an SSEPublisher has no single connection
+// state, it serves any number of clients over HTTP.
+func (p *SSEPublisher) Connected() bool { return true }
+
+// ServeHTTP implements the SSE endpoint subscribers connect to: a POST
+// registers interest in a key, a GET opens the event stream, replaying
+// anything published since Last-Event-ID.
+func (p *SSEPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		p.handleSubscribe(w, r)
+		return
+	}
+	p.handleStream(w, r)
+}
+
+func (p *SSEPublisher) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientID := r.FormValue("client")
+	key := r.FormValue("key")
+	if clientID == "" || key == "" {
+		http.Error(w, "client and key are required", http.StatusBadRequest)
+		return
+	}
+
+	c := p.client(clientID)
+	c.mu.Lock()
+	c.keys[key] = true
+	c.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *SSEPublisher) handleStream(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client")
+	if clientID == "" {
+		http.Error(w, "client is required", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	c := p.client(clientID)
+
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		if id, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+			p.replay(c, id, w)
+			flusher.Flush()
+		}
+	}
+
+	for {
+		select {
+		case ev := <-c.ch:
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.id, ev.data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// replay writes every ring buffer event newer than afterID that c is
+// subscribed to, so a reconnecting client doesn't miss messages published
+// while it was disconnected.
+func (p *SSEPublisher) replay(c *sseClient, afterID int64, w io.Writer) {
+	p.mu.Lock()
+	events := append([]sseEvent(nil), p.ring...)
+	p.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ev := range events {
+		if ev.id <= afterID || !c.keys[ev.key] {
+			continue
+		}
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.id, ev.data)
+	}
+}
@@ -0,0 +1,77 @@
+package moh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSSEPublisherReplaySkipsAlreadySeenEvents(t *testing.T) {
+	p := NewSSEPublisher()
+	c := p.client("client-1")
+	c.keys["room-1"] = true
+
+	p.Publish("room-1", []byte("first"))
+	p.Publish("room-1", []byte("second"))
+	p.Publish("room-1", []byte("third"))
+
+	var buf bytes.Buffer
+	p.replay(c, 1, &buf)
+
+	out := buf.String()
+	if strings.Contains(out, "first") {
+		t.Errorf("replay(afterID=1) should not include event 1 (first), got:\n%s", out)
+	}
+	if !strings.Contains(out, "second") || !strings.Contains(out, "third") {
+		t.Errorf("replay(afterID=1) should include events 2 and 3, got:\n%s", out)
+	}
+}
+
+func TestSSEPublisherReplaySkipsUnsubscribedKeys(t *testing.T) {
+	p := NewSSEPublisher()
+	c := p.client("client-1")
+	c.keys["room-1"] = true
+
+	p.Publish("room-1", []byte("relevant"))
+	p.Publish("room-2", []byte("irrelevant"))
+
+	var buf bytes.Buffer
+	p.replay(c, 0, &buf)
+
+	out := buf.String()
+	if !strings.Contains(out, "relevant") {
+		t.Errorf("replay should include events for a subscribed key, got:\n%s", out)
+	}
+	if strings.Contains(out, "irrelevant") {
+		t.Errorf("replay should not include events for an unsubscribed key, got:\n%s", out)
+	}
+}
+
+func TestSSEPublisherRingBufferEvictsOldestPastCap(t *testing.T) {
+	p := NewSSEPublisher()
+	p.ringCap = 2
+	c := p.client("client-1")
+	c.keys["room-1"] = true
+
+	p.Publish("room-1", []byte("one"))
+	p.Publish("room-1", []byte("two"))
+	p.Publish("room-1", []byte("three"))
+
+	p.mu.Lock()
+	ringLen := len(p.ring)
+	p.mu.Unlock()
+	if ringLen != 2 {
+		t.Fatalf("ring buffer length = %d, want 2 (capped)", ringLen)
+	}
+
+	var buf bytes.Buffer
+	p.replay(c, 0, &buf)
+
+	out := buf.String()
+	if strings.Contains(out, "one") {
+		t.Errorf("replay should not surface an event evicted from the ring buffer, got:\n%s", out)
+	}
+	if !strings.Contains(out, "two") || !strings.Contains(out, "three") {
+		t.Errorf("replay should surface events still in the ring buffer, got:\n%s", out)
+	}
+}
@@ -1,12 +1,80 @@
 package moh
 
 import (
-	"code.google.com/p/go.net/websocket"
-	"log"
+	"math/rand"
 	"net/url"
+	"os"
+	"sync"
 	"time"
+
+	"code.google.com/p/go.net/websocket"
+
+	"koding/kites/kloud/logging"
 )
 
+// SubscriberOptions configures the reconnect and heartbeat behavior of a
+// Subscriber.
+type SubscriberOptions struct {
+	// MaxRetries caps the number of consecutive reconnect attempts the
+	// Subscriber makes before giving up. Zero means retry forever.
+	MaxRetries int
+
+	// InitialBackoff is the delay after the first failed reconnect attempt;
+	// the first attempt itself is made immediately.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the ceiling the exponential backoff is capped at.
+	MaxBackoff time.Duration
+
+	// PingInterval is how often a heartbeat ping is sent over an established
+	// connection. Negative disables heartbeats; zero means DefaultSubscriberOptions's
+	// PingInterval.
+	PingInterval time.Duration
+
+	// PongTimeout is how long the Subscriber waits for any activity on the
+	// connection, after a ping, before considering it dead and reconnecting.
+	PongTimeout time.Duration
+
+	// OnStateChange, if set, is called whenever the Subscriber connects or
+	// disconnects.
+	OnStateChange func(connected bool)
+
+	// Logger receives the Subscriber's connect/reconnect/heartbeat activity.
+	// Defaults to a JSON logger on os.Stdout.
+	Logger logging.Logger
+}
+
+// DefaultSubscriberOptions returns the SubscriberOptions used when none are
+// given to NewSubscriber.
+func DefaultSubscriberOptions() SubscriberOptions {
+	return SubscriberOptions{
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		PingInterval:   30 * time.Second,
+		PongTimeout:    10 * time.Second,
+	}
+}
+
+func (o SubscriberOptions) withDefaults() SubscriberOptions {
+	d := DefaultSubscriberOptions()
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = d.InitialBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = d.MaxBackoff
+	}
+	if o.PingInterval == 0 {
+		o.PingInterval = d.PingInterval
+	}
+	if o.PongTimeout <= 0 {
+		o.PongTimeout = d.PongTimeout
+	}
+	if o.Logger == nil {
+		o.Logger = logging.New(os.Stdout)
+	}
+	return o
+}
+
 // Subscriber is a websocket client that is used to connect to a Publisher and consume published messages.
 type Subscriber struct {
 	// Path of the server to be connected
@@ -18,12 +86,18 @@ type Subscriber struct {
 
 	// Consumed messages will be handled with this function.
 	handler MessageHandler
+
+	opts SubscriberOptions
+
+	mu           sync.Mutex
+	keys         map[string]bool
+	lastActivity time.Time
 }
 
 // NewSubscriber opens a websocket connection to a Publisher and
 // returns a pointer to newly created Subscriber.
 // After creating a Subscriber you should subscribe to messages with Subscribe function.
-func NewSubscriber(urlStr string, handler MessageHandler) (*Subscriber, error) {
+func NewSubscriber(urlStr string, handler MessageHandler, opts SubscriberOptions) (*Subscriber, error) {
 	parsed, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, err
@@ -32,13 +106,22 @@ func NewSubscriber(urlStr string, handler MessageHandler) (*Subscriber, error) {
 	sub := &Subscriber{
 		url:     parsed,
 		handler: handler,
+		opts:    opts.withDefaults(),
+		keys:    make(map[string]bool),
 	}
+	sub.opts.Logger = sub.opts.Logger.WithFields(logging.Fields{"url": urlStr})
 
 	err = sub.connect()
 	if err != nil {
 		return nil, err
 	}
 
+	sub.markActivity()
+	sub.notifyState(true)
+
+	if sub.opts.PingInterval > 0 {
+		go sub.heartbeat()
+	}
 	go sub.consumer()
 	return sub, err
 }
@@ -52,6 +135,14 @@ type args map[string]interface{}
 
 // Subscribe registers the Subscriber to receive messages matching with the key.
 func (s *Subscriber) Subscribe(key string) error {
+	s.mu.Lock()
+	s.keys[key] = true
+	s.mu.Unlock()
+
+	return s.sendSubscribe(key)
+}
+
+func (s *Subscriber) sendSubscribe(key string) error {
 	cmd := subscriberCommand{
 		Name: "subscribe",
 		Args: args{"key": key},
@@ -59,16 +150,34 @@ func (s *Subscriber) Subscribe(key string) error {
 	return websocket.JSON.Send(s.ws, cmd)
 }
 
+// resubscribe resends a subscribe command for every key the Subscriber has
+// ever been asked to subscribe to. It's called after a reconnect, since the
+// Publisher has no memory of a dropped connection's subscriptions.
+func (s *Subscriber) resubscribe() {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+
+	for _, key := range keys {
+		if err := s.sendSubscribe(key); err != nil {
+			s.opts.Logger.Warn("failed to resubscribe to key %s: %s", key, err)
+		}
+	}
+}
+
 func (s *Subscriber) connect() error {
 	url := s.url.String()
 	origin := "http://localhost/" // dont know if this is required
-	log.Println("Connecting to url:", url)
+	s.opts.Logger.Debug("connecting to url %s", url)
 	ws, err := websocket.Dial(url, "", origin)
 	if err != nil {
-		log.Println("Cannot connect")
+		s.opts.Logger.Warn("connect failed: %s", err)
 		return err
 	}
-	log.Println("Connection is successfull")
+	s.opts.Logger.Debug("connected")
 	s.ws = ws
 	return nil
 }
@@ -80,37 +189,127 @@ func (s *Subscriber) Connected() bool {
 	return s.ws != nil
 }
 
-// connector tries to connect to the server forever.
-// When the connection is established it runs a consumer() goroutine and returns.
+func (s *Subscriber) notifyState(connected bool) {
+	if s.opts.OnStateChange != nil {
+		s.opts.OnStateChange(connected)
+	}
+}
+
+func (s *Subscriber) markActivity() {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
+}
+
+// backoff returns the delay to wait after failed reconnect attempt n (0-indexed),
+// as exponential backoff with base InitialBackoff, factor 2, capped at
+// MaxBackoff and jittered by ±20%.
+func backoff(attempt int, opts SubscriberOptions) time.Duration {
+	d := opts.InitialBackoff
+	for i := 0; i < attempt; i++ {
+		d *= 2
+		if d >= opts.MaxBackoff {
+			d = opts.MaxBackoff
+			break
+		}
+	}
+
+	jitter := time.Duration(float64(d) * 0.2 * (2*rand.Float64() - 1))
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// connector tries to connect to the server forever (or until MaxRetries is
+// reached), backing off between attempts. When the connection is
+// established it resubscribes to previously-registered keys and starts the
+// heartbeat and consumer goroutines, then returns.
 func (s *Subscriber) connector() {
-	for {
-		err := s.connect()
-		if err != nil {
-			time.Sleep(100 * time.Millisecond)
+	for attempt := 0; ; attempt++ {
+		if s.opts.MaxRetries > 0 && attempt >= s.opts.MaxRetries {
+			s.opts.Logger.Error("giving up reconnecting after %d attempts", attempt)
+			return
+		}
+
+		if err := s.connect(); err != nil {
+			d := backoff(attempt, s.opts)
+			s.opts.Logger.Warn("reconnect attempt %d failed, retrying in %s: %s", attempt, d, err)
+			time.Sleep(d)
 			continue
 		}
+
+		s.markActivity()
+		s.notifyState(true)
+		s.resubscribe()
+
+		if s.opts.PingInterval > 0 {
+			go s.heartbeat()
+		}
 		go s.consumer()
 		return
 	}
 }
 
+// heartbeat periodically pings the Publisher and forces a reconnect if no
+// activity (a pong, or any other message) has been seen within PongTimeout.
+func (s *Subscriber) heartbeat() {
+	ws := s.ws
+	ticker := time.NewTicker(s.opts.PingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.ws != ws {
+			// a reconnect already happened under us; let the new
+			// heartbeat goroutine take over.
+			return
+		}
+
+		cmd := subscriberCommand{Name: "ping"}
+		if err := websocket.JSON.Send(ws, cmd); err != nil {
+			return
+		}
+		pingSentAt := time.Now()
+
+		// Give the pong (or any other activity) PongTimeout to arrive
+		// before judging the connection dead.
+		time.Sleep(s.opts.PongTimeout)
+
+		if s.ws != ws {
+			return
+		}
+
+		s.mu.Lock()
+		stale := s.lastActivity.Before(pingSentAt)
+		s.mu.Unlock()
+
+		if stale {
+			s.opts.Logger.Warn("no activity within %s, reconnecting", s.opts.PongTimeout)
+			ws.Close()
+			return
+		}
+	}
+}
+
 // consumer reads the messages from websocket until the connection is dropped.
 // When the connection drops it runs a connector() goroutine and returns.
 func (s *Subscriber) consumer() {
 	for {
 		var message []byte
-		log.Println("Reading from websocket")
 		err := websocket.Message.Receive(s.ws, &message)
 		if err != nil {
-			log.Println("Cannot read message from websocket")
+			s.opts.Logger.Warn("cannot read message from websocket: %s", err)
 			s.ws.Close()
 			// Connected() checks this pointer.
 			// Set it to nil to indicate that we are disconnected.
 			s.ws = nil
+			s.notifyState(false)
 			go s.connector()
 			return
 		}
-		log.Println("Received data:", message)
+		s.opts.Logger.Debug("received data: %s", message)
+		s.markActivity()
 		s.handler(message)
 	}
 }
@@ -0,0 +1,150 @@
+package moh
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+func TestBackoffGrowsExponentiallyAndCapsAtMaxBackoff(t *testing.T) {
+	opts := SubscriberOptions{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+	}
+
+	// Jitter is ±20%, so bound each attempt against the undershot/overshot
+	// base rather than asserting an exact value.
+	cases := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{10, 1 * time.Second}, // capped
+	}
+
+	for _, c := range cases {
+		d := backoff(c.attempt, opts)
+		min := time.Duration(float64(c.base) * 0.8)
+		max := time.Duration(float64(c.base) * 1.2)
+		if d < min || d > max {
+			t.Errorf("backoff(%d) = %s, want within [%s, %s]", c.attempt, d, min, max)
+		}
+	}
+}
+
+func TestBackoffNeverNegative(t *testing.T) {
+	opts := SubscriberOptions{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	for attempt := 0; attempt < 5; attempt++ {
+		if d := backoff(attempt, opts); d < 0 {
+			t.Fatalf("backoff(%d) = %s, want >= 0", attempt, d)
+		}
+	}
+}
+
+// dialTestWS starts a websocket server driven by handler and dials a client
+// connection to it, returning the client side ready for a Subscriber to use.
+func dialTestWS(t *testing.T, handler func(*websocket.Conn)) (*websocket.Conn, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(websocket.Handler(handler))
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ws, err := websocket.Dial(wsURL, "", "http://localhost/")
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+
+	return ws, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+// TestHeartbeatSurvivesAHealthyConnection is a regression test for a bug
+// where heartbeat checked staleness against the activity seen before the
+// ping currently in flight was even sent, so it judged every connection
+// dead after exactly one PingInterval no matter how responsive the server
+// was. A server that replies to every ping well within PongTimeout must
+// not get disconnected.
+func TestHeartbeatSurvivesAHealthyConnection(t *testing.T) {
+	ws, cleanup := dialTestWS(t, func(ws *websocket.Conn) {
+		for {
+			var cmd subscriberCommand
+			if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+				return
+			}
+			if err := websocket.JSON.Send(ws, subscriberCommand{Name: "pong"}); err != nil {
+				return
+			}
+		}
+	})
+	defer cleanup()
+
+	sub := &Subscriber{
+		ws: ws,
+		opts: SubscriberOptions{
+			PingInterval: 20 * time.Millisecond,
+			PongTimeout:  100 * time.Millisecond,
+		}.withDefaults(),
+	}
+	sub.markActivity()
+
+	go func() {
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			sub.markActivity()
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		sub.heartbeat()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("heartbeat gave up on a connection that was replying to every ping")
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+// TestHeartbeatClosesAnUnresponsiveConnection is the flip side: a server
+// that never replies should still get disconnected once PongTimeout has
+// actually elapsed since the ping was sent.
+func TestHeartbeatClosesAnUnresponsiveConnection(t *testing.T) {
+	ws, cleanup := dialTestWS(t, func(ws *websocket.Conn) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	defer cleanup()
+
+	sub := &Subscriber{
+		ws: ws,
+		opts: SubscriberOptions{
+			PingInterval: 10 * time.Millisecond,
+			PongTimeout:  30 * time.Millisecond,
+		}.withDefaults(),
+	}
+	sub.markActivity()
+
+	done := make(chan struct{})
+	go func() {
+		sub.heartbeat()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("heartbeat never closed a connection with no replies")
+	}
+}